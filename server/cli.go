@@ -1,21 +1,61 @@
 package main
 
 import (
-	"log"
+	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 func init() {
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Log level (debug, info, warn, error)")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "Log format (text, json)")
+
 	runCmd.Flags().IntVarP(&port, "port", "p", 1080, "Port to listen on")
 	runCmd.Flags().BoolVar(&useTLS, "tls", false, "Use TLS for connections")
+	runCmd.Flags().StringVar(&tlsCertFile, "tls-cert", "", "PEM certificate file for TLS (self-signed if empty)")
+	runCmd.Flags().StringVar(&tlsKeyFile, "tls-key", "", "PEM private key file for TLS (self-signed if empty)")
+	runCmd.Flags().StringVar(&clientCAFile, "client-ca", "", "PEM CA file used to require and verify agent certificates")
 	runCmd.Flags().BoolVar(&useTor, "tor", false, "Use Tor for connections")
+	runCmd.Flags().StringVar(&torControlAddr, "tor-control", "127.0.0.1:9051", "Address of the tor control port")
+	runCmd.Flags().StringVar(&torPassword, "tor-password", "", "Password for the tor control port (or REVSOCKS_TOR_PASSWORD)")
+	runCmd.Flags().StringVar(&authToken, "auth-token", "", "Pre-shared token agents must send after the magic bytes (or REVSOCKS_AUTH_TOKEN)")
+	runCmd.Flags().StringVar(&socksBind, "socks-bind", "", "Address to bind per-agent SOCKS listeners on (all interfaces if empty)")
+	runCmd.Flags().IntVar(&socksPort, "socks-port", 0, "Fixed port for the per-agent SOCKS listener (single agent)")
+	runCmd.Flags().StringVar(&socksPortRange, "socks-port-range", "", "Port range for per-agent SOCKS listeners, e.g. 20000-20100")
+	runCmd.Flags().StringVar(&socksUser, "socks-user", "", "Username required from SOCKS5 clients (or REVSOCKS_SOCKS_USER)")
+	runCmd.Flags().StringVar(&socksPass, "socks-pass", "", "Password required from SOCKS5 clients (or REVSOCKS_SOCKS_PASS)")
+	runCmd.Flags().DurationVar(&healthInterval, "health-interval", 5*time.Second, "Interval between agent health checks")
+	runCmd.Flags().DurationVar(&healthTimeout, "health-timeout", 5*time.Second, "Timeout for a single agent health check (at most the interval)")
+	runCmd.Flags().IntVar(&healthMaxFailures, "health-max-failures", 1, "Consecutive failed health checks before an agent is dropped")
+	runCmd.Flags().DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "Time to wait for active tunnels to finish on stop")
 	runCmd.MarkFlagsMutuallyExclusive("tls", "tor")
+	runCmd.MarkFlagsRequiredTogether("socks-user", "socks-pass")
+	runCmd.MarkFlagsRequiredTogether("tls-cert", "tls-key")
+	runCmd.MarkFlagsMutuallyExclusive("socks-port", "socks-port-range")
 
 	startCmd.Flags().IntVarP(&port, "port", "p", 1080, "Port to listen on")
 	startCmd.Flags().BoolVar(&useTLS, "tls", false, "Use TLS for connections")
+	startCmd.Flags().StringVar(&tlsCertFile, "tls-cert", "", "PEM certificate file for TLS (self-signed if empty)")
+	startCmd.Flags().StringVar(&tlsKeyFile, "tls-key", "", "PEM private key file for TLS (self-signed if empty)")
+	startCmd.Flags().StringVar(&clientCAFile, "client-ca", "", "PEM CA file used to require and verify agent certificates")
 	startCmd.Flags().BoolVar(&useTor, "tor", false, "Use Tor for connections")
+	startCmd.Flags().StringVar(&torControlAddr, "tor-control", "127.0.0.1:9051", "Address of the tor control port")
+	startCmd.Flags().StringVar(&torPassword, "tor-password", "", "Password for the tor control port (or REVSOCKS_TOR_PASSWORD)")
+	startCmd.Flags().StringVar(&authToken, "auth-token", "", "Pre-shared token agents must send after the magic bytes (or REVSOCKS_AUTH_TOKEN)")
+	startCmd.Flags().StringVar(&socksBind, "socks-bind", "", "Address to bind per-agent SOCKS listeners on (all interfaces if empty)")
+	startCmd.Flags().IntVar(&socksPort, "socks-port", 0, "Fixed port for the per-agent SOCKS listener (single agent)")
+	startCmd.Flags().StringVar(&socksPortRange, "socks-port-range", "", "Port range for per-agent SOCKS listeners, e.g. 20000-20100")
+	startCmd.Flags().StringVar(&socksUser, "socks-user", "", "Username required from SOCKS5 clients (or REVSOCKS_SOCKS_USER)")
+	startCmd.Flags().StringVar(&socksPass, "socks-pass", "", "Password required from SOCKS5 clients (or REVSOCKS_SOCKS_PASS)")
+	startCmd.Flags().DurationVar(&healthInterval, "health-interval", 5*time.Second, "Interval between agent health checks")
+	startCmd.Flags().DurationVar(&healthTimeout, "health-timeout", 5*time.Second, "Timeout for a single agent health check (at most the interval)")
+	startCmd.Flags().IntVar(&healthMaxFailures, "health-max-failures", 1, "Consecutive failed health checks before an agent is dropped")
+	startCmd.Flags().DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "Time to wait for active tunnels to finish on stop")
 	startCmd.MarkFlagsMutuallyExclusive("tls", "tor")
+	startCmd.MarkFlagsRequiredTogether("socks-user", "socks-pass")
+	startCmd.MarkFlagsRequiredTogether("tls-cert", "tls-key")
+	startCmd.MarkFlagsMutuallyExclusive("socks-port", "socks-port-range")
 
 	rootCmd.AddCommand(runCmd)
 	rootCmd.AddCommand(startCmd)
@@ -26,7 +66,8 @@ func init() {
 
 func main() {
 	if err := rootCmd.Execute(); err != nil {
-		log.Fatal(err)
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 }
 
@@ -37,6 +78,11 @@ var rootCmd = &cobra.Command{
 	CompletionOptions: cobra.CompletionOptions{
 		DisableDefaultCmd: true,
 	},
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		logger, err = newLogger(os.Stderr, logLevel, logFormat)
+		return err
+	},
 }
 
 var runCmd = &cobra.Command{
@@ -2,28 +2,53 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 func runServer() error {
-	daemonService := NewDaemonService()
-	go func() {
-		if err := daemonService.Start(); err != nil {
-			log.Fatalf("failed to start daemon service: %v", err)
+	loadSecretsFromEnv()
+	if (socksUser == "") != (socksPass == "") {
+		return fmt.Errorf("SOCKS username and password must be set together")
+	}
+	if healthInterval <= 0 || healthTimeout <= 0 {
+		return fmt.Errorf("health interval and timeout must be positive")
+	}
+	if healthTimeout > healthInterval {
+		return fmt.Errorf("health timeout (%v) must not exceed health interval (%v)", healthTimeout, healthInterval)
+	}
+	if healthMaxFailures < 1 {
+		return fmt.Errorf("health max failures must be at least 1")
+	}
+	if !useTLS && (tlsCertFile != "" || tlsKeyFile != "" || clientCAFile != "") {
+		return fmt.Errorf("--tls-cert, --tls-key and --client-ca require --tls")
+	}
+	if socksPortRange != "" {
+		if _, _, err := parsePortRange(socksPortRange); err != nil {
+			return err
 		}
-	}()
+	}
+	if socksPort < 0 || socksPort > 65535 {
+		return fmt.Errorf("invalid SOCKS port %d: must be between 1 and 65535", socksPort)
+	}
 
 	var listener net.Listener
 	var err error
 	if useTLS {
-		tlsConfig, err := generateTLSConfig()
+		var tlsConfig *tls.Config
+		tlsConfig, err = loadTLSConfig(tlsCertFile, tlsKeyFile, clientCAFile)
 		if err != nil {
-			return fmt.Errorf("failed to generate TLS config: %v", err)
+			return fmt.Errorf("failed to load TLS config: %v", err)
 		}
 		listener, err = tls.Listen("tcp", fmt.Sprintf(":%d", port), tlsConfig)
+	} else if useTor {
+		listener, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
 	} else {
 		listener, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
 	}
@@ -32,47 +57,207 @@ func runServer() error {
 	}
 	defer listener.Close()
 
-	log.Printf("Server started, listening on %s for agents", listener.Addr().String())
+	if useTor {
+		onion, err := newTorOnion(torControlAddr, torPassword, port, listener.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer onion.Close()
+		logger.Info("Onion service published", "address", fmt.Sprintf("%s:%d", onion.Address(), port))
+	}
+
+	drained := make(chan error, 1)
+	daemonService := NewDaemonService(func() error {
+		err := drainServer(listener, drainTimeout)
+		drained <- err
+		return err
+	}, logger)
+	daemonDone := make(chan struct{})
+	go func() {
+		if err := daemonService.Start(); err != nil {
+			logger.Error("Failed to start daemon service", "error", err)
+			os.Exit(1)
+		}
+		close(daemonDone)
+	}()
+
+	logger.Info("Server started, listening for agents", "listen_addr", listener.Addr().String())
+
+	acceptAgents(listener)
+	err = <-drained
+	<-daemonDone
+	return err
+}
 
+// acceptAgents accepts agents until listener is closed. The handshake runs in
+// each connection's own goroutine so a silent agent cannot hold up the rest.
+func acceptAgents(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Error accepting connection: %s", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Warn("Error accepting connection", "error", err)
 			continue
 		}
 
-		log.Printf("New connection from %v", conn.RemoteAddr())
-		if err := validateMagicBytes(conn); err != nil {
-			log.Printf("Magic bytes validation failed for %v: %s", conn.RemoteAddr(), err)
+		connLogger := logger.With("remote_addr", conn.RemoteAddr().String())
+		connLogger.Info("New connection")
+		go serveAgent(connLogger, conn, authToken)
+	}
+}
+
+// serveAgent checks the magic bytes and, when token is set, the agent's auth
+// token before handing the connection to handleConnection.
+func serveAgent(logger *slog.Logger, conn net.Conn, token string) {
+	if err := validateMagicBytes(logger, conn); err != nil {
+		logger.Warn("Magic bytes validation failed", "error", err)
+		conn.Close()
+		return
+	}
+	if token != "" {
+		if err := validateAuthToken(logger, conn, token); err != nil {
+			logger.Warn("Auth token validation failed", "error", err)
 			conn.Close()
-			continue
+			return
 		}
+	}
+
+	handleConnection(logger, conn)
+}
+
+// drainServer stops accepting agents, waits up to timeout for active tunnels
+// to finish and then closes every connection handler.
+func drainServer(listener net.Listener, timeout time.Duration) error {
+	logger.Info("Shutting down, draining active connections")
+	listener.Close()
+
+	handlers := connections.Snapshot()
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, handler := range handlers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handler.Drain()
+			}()
+		}
+		wg.Wait()
+		close(done)
+	}()
 
-		go handleConnection(conn)
+	var err error
+	select {
+	case <-done:
+		logger.Info("All connections drained")
+	case <-time.After(timeout):
+		err = fmt.Errorf("drain timed out after %v, forcing %d connections closed", timeout, len(handlers))
+	}
+
+	for _, handler := range handlers {
+		handler.Close()
 	}
+	return err
 }
 
-func startServer(args []string) error {
-	procArgs := []string{os.Args[0], "run"}
-	procArgs = append(procArgs, "-p", fmt.Sprintf("%d", port))
-	if useTLS {
-		procArgs = append(procArgs, "--tls")
+// Secrets are handed to the daemon through its environment rather than argv,
+// which any local user can read from ps.
+var secretEnv = []struct {
+	name  string
+	value *string
+}{
+	{"REVSOCKS_AUTH_TOKEN", &authToken},
+	{"REVSOCKS_SOCKS_USER", &socksUser},
+	{"REVSOCKS_SOCKS_PASS", &socksPass},
+	{"REVSOCKS_TOR_PASSWORD", &torPassword},
+}
+
+// daemonEnv returns environ with the secret variables replaced by the
+// current flag values.
+func daemonEnv(environ []string) []string {
+	env := make([]string, 0, len(environ)+len(secretEnv))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		secret := false
+		for _, s := range secretEnv {
+			if s.name == name {
+				secret = true
+				break
+			}
+		}
+		if !secret {
+			env = append(env, kv)
+		}
 	}
-	if useTor {
-		procArgs = append(procArgs, "--tor")
+	for _, s := range secretEnv {
+		if *s.value != "" {
+			env = append(env, s.name+"="+*s.value)
+		}
 	}
-	procArgs = append(procArgs, args...)
+	return env
+}
 
-	proc, err := os.StartProcess(os.Args[0], procArgs, &os.ProcAttr{
+// loadSecretsFromEnv fills secrets that were not given as flags from the
+// environment.
+func loadSecretsFromEnv() {
+	for _, s := range secretEnv {
+		if *s.value == "" {
+			*s.value = os.Getenv(s.name)
+		}
+	}
+}
+
+func startServer(args []string) error {
+	proc, err := os.StartProcess(os.Args[0], daemonArgs(args), &os.ProcAttr{
+		Env:   daemonEnv(os.Environ()),
 		Files: []*os.File{nil, nil, nil},
 	})
 	if err != nil {
 		return fmt.Errorf("failed to start daemon process: %v", err)
 	}
-	log.Printf("Started daemon process with PID %d", proc.Pid)
+	logger.Info("Started daemon process", "pid", proc.Pid)
 	return nil
 }
 
+// daemonArgs builds the argv for the background "run" process from the
+// current flags. Secrets are left out; see daemonEnv.
+func daemonArgs(args []string) []string {
+	procArgs := []string{os.Args[0], "run"}
+	procArgs = append(procArgs, "--log-level", logLevel, "--log-format", logFormat)
+	procArgs = append(procArgs, "-p", fmt.Sprintf("%d", port))
+	procArgs = append(procArgs, "--health-interval", healthInterval.String())
+	procArgs = append(procArgs, "--health-timeout", healthTimeout.String())
+	procArgs = append(procArgs, "--health-max-failures", fmt.Sprintf("%d", healthMaxFailures))
+	procArgs = append(procArgs, "--drain-timeout", drainTimeout.String())
+	if useTLS {
+		procArgs = append(procArgs, "--tls")
+		if tlsCertFile != "" {
+			procArgs = append(procArgs, "--tls-cert", tlsCertFile)
+		}
+		if tlsKeyFile != "" {
+			procArgs = append(procArgs, "--tls-key", tlsKeyFile)
+		}
+		if clientCAFile != "" {
+			procArgs = append(procArgs, "--client-ca", clientCAFile)
+		}
+	}
+	if useTor {
+		procArgs = append(procArgs, "--tor", "--tor-control", torControlAddr)
+	}
+	if socksBind != "" {
+		procArgs = append(procArgs, "--socks-bind", socksBind)
+	}
+	if socksPort != 0 {
+		procArgs = append(procArgs, "--socks-port", fmt.Sprintf("%d", socksPort))
+	}
+	if socksPortRange != "" {
+		procArgs = append(procArgs, "--socks-port-range", socksPortRange)
+	}
+	return append(procArgs, args...)
+}
+
 func stopServer() error {
 	client := NewDaemonClient()
 	return client.Shutdown()
@@ -86,10 +271,10 @@ func listConnections() error {
 	}
 
 	fmt.Printf("\nActive connections:\n")
-	fmt.Printf("%-10s %-15s %-21s\n", "ID", "IP", "Listen Address")
-	fmt.Printf("%-10s %-15s %-21s\n", "----------", "---------------", "---------------------")
+	fmt.Printf("%-10s %-15s %-21s %-12s %-12s\n", "ID", "IP", "Listen Address", "Bytes In", "Bytes Out")
+	fmt.Printf("%-10s %-15s %-21s %-12s %-12s\n", "----------", "---------------", "---------------------", "------------", "------------")
 	for _, info := range infos {
-		fmt.Printf("%-10s %-15s %-21s\n", info.ID, info.IP, info.ListenAddr)
+		fmt.Printf("%-10s %-15s %-21s %-12d %-12d\n", info.ID, info.IP, info.ListenAddr, info.BytesIn, info.BytesOut)
 	}
 	fmt.Println()
 
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// setRunDefaults resets the run flags to their CLI defaults for the test.
+func setRunDefaults(t *testing.T) {
+	t.Helper()
+	oldTLS, oldCert, oldKey, oldCA := useTLS, tlsCertFile, tlsKeyFile, clientCAFile
+	oldInterval, oldTimeout, oldFailures := healthInterval, healthTimeout, healthMaxFailures
+	t.Cleanup(func() {
+		useTLS, tlsCertFile, tlsKeyFile, clientCAFile = oldTLS, oldCert, oldKey, oldCA
+		healthInterval, healthTimeout, healthMaxFailures = oldInterval, oldTimeout, oldFailures
+	})
+
+	useTLS, tlsCertFile, tlsKeyFile, clientCAFile = false, "", "", ""
+	healthInterval, healthTimeout, healthMaxFailures = 5*time.Second, 5*time.Second, 1
+}
+
+func TestRunServerRejectsTLSFilesWithoutTLS(t *testing.T) {
+	for _, set := range []func(){
+		func() { tlsCertFile, tlsKeyFile = "server.crt", "server.key" },
+		func() { clientCAFile = "ca.crt" },
+	} {
+		setRunDefaults(t)
+		set()
+		err := runServer()
+		if err == nil || !strings.Contains(err.Error(), "require --tls") {
+			t.Fatalf("got %v, want error requiring --tls", err)
+		}
+	}
+}
+
+func TestRunServerRejectsInvalidSocksPort(t *testing.T) {
+	setRunDefaults(t)
+	oldPort := socksPort
+	t.Cleanup(func() { socksPort = oldPort })
+
+	for _, p := range []int{-1, 65536, 70000} {
+		socksPort = p
+		err := runServer()
+		if err == nil || !strings.Contains(err.Error(), "invalid SOCKS port") {
+			t.Fatalf("port %d: got %v, want invalid port error", p, err)
+		}
+	}
+}
+
+func TestRunServerRejectsHealthTimeoutAboveInterval(t *testing.T) {
+	setRunDefaults(t)
+	healthInterval, healthTimeout = time.Second, 2*time.Second
+
+	err := runServer()
+	if err == nil || !strings.Contains(err.Error(), "must not exceed health interval") {
+		t.Fatalf("got %v, want health timeout error", err)
+	}
+}
+
+// startDrainAgent runs a real handleConnection for a loopback agent and
+// returns the agent session and the handler once it is registered.
+func startDrainAgent(t *testing.T) (*ConnectionHandler, *yamux.Session) {
+	t.Helper()
+	setSocksCredentials(t, "", "")
+	setHealthConfig(t, time.Minute, time.Second, 1)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	agentConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+
+	agent, err := yamux.Server(agentConn, nil)
+	if err != nil {
+		t.Fatalf("failed to create agent session: %v", err)
+	}
+	t.Cleanup(func() { agent.Close() })
+
+	finished := make(chan struct{})
+	go func() {
+		handleConnection(logger, serverConn)
+		close(finished)
+	}()
+	t.Cleanup(func() {
+		serverConn.Close()
+		<-finished
+	})
+
+	id := generateConnectionID(serverConn)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if handler, ok := connections.Get(id); ok {
+			return handler, agent
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("handler was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDrainServerWaitsForActiveCopy(t *testing.T) {
+	handler, agent := startDrainAgent(t)
+	socksAddr := handler.socksClientListener.Addr().String()
+
+	client, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("failed to dial socks listener: %v", err)
+	}
+	defer client.Close()
+	writeAll(t, client, []byte("before"))
+	stream := acceptStream(t, agent)
+	readExactly(t, stream, len("before"))
+
+	agentListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- drainServer(agentListener, 5*time.Second)
+	}()
+
+	// Wait for the drain to close the SOCKS listener.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", socksAddr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("SOCKS listener still accepting while draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := agentListener.Accept(); err == nil {
+		t.Fatal("agent listener still open while draining")
+	}
+
+	// The in-flight tunnel keeps working until it finishes on its own.
+	writeAll(t, client, []byte("after"))
+	if got := readExactly(t, stream, len("after")); string(got) != "after" {
+		t.Fatalf("agent got %q during drain, want %q", got, "after")
+	}
+	select {
+	case err := <-result:
+		t.Fatalf("drain finished with an active copy: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	client.Close()
+	stream.Close()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("clean drain returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not finish after the copy completed")
+	}
+	if _, ok := connections.Get(generateConnectionID(handler.conn)); ok {
+		t.Fatal("handler still registered after drain")
+	}
+}
+
+func TestDrainServerForcesCloseOnTimeout(t *testing.T) {
+	handler, agent := startDrainAgent(t)
+
+	client, err := net.Dial("tcp", handler.socksClientListener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial socks listener: %v", err)
+	}
+	defer client.Close()
+	writeAll(t, client, []byte("idle"))
+	stream := acceptStream(t, agent)
+	defer stream.Close()
+	readExactly(t, stream, len("idle"))
+
+	agentListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	err = drainServer(agentListener, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "drain timed out") {
+		t.Fatalf("got %v, want drain timeout", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("tunnel still open after forced close")
+	}
+}
+
+func setSecrets(t *testing.T, token, user, pass, torPass string) {
+	t.Helper()
+	oldToken, oldUser, oldPass, oldTor := authToken, socksUser, socksPass, torPassword
+	authToken, socksUser, socksPass, torPassword = token, user, pass, torPass
+	t.Cleanup(func() {
+		authToken, socksUser, socksPass, torPassword = oldToken, oldUser, oldPass, oldTor
+	})
+}
+
+func TestDaemonSecretsNotInArgv(t *testing.T) {
+	setSecrets(t, "agent-token", "alice", "socks-secret", "tor-secret")
+	oldTor := useTor
+	useTor = true
+	t.Cleanup(func() { useTor = oldTor })
+
+	argv := strings.Join(daemonArgs(nil), " ")
+	for _, secret := range []string{"agent-token", "socks-secret", "tor-secret"} {
+		if strings.Contains(argv, secret) {
+			t.Fatalf("secret %q leaked into daemon argv: %s", secret, argv)
+		}
+	}
+
+	env := daemonEnv([]string{"PATH=/bin", "REVSOCKS_AUTH_TOKEN=stale"})
+	want := map[string]bool{
+		"PATH=/bin":                        true,
+		"REVSOCKS_AUTH_TOKEN=agent-token":  true,
+		"REVSOCKS_SOCKS_USER=alice":        true,
+		"REVSOCKS_SOCKS_PASS=socks-secret": true,
+		"REVSOCKS_TOR_PASSWORD=tor-secret": true,
+	}
+	if len(env) != len(want) {
+		t.Fatalf("unexpected daemon env %v", env)
+	}
+	for _, kv := range env {
+		if !want[kv] {
+			t.Fatalf("unexpected daemon env entry %q in %v", kv, env)
+		}
+	}
+}
+
+func TestLoadSecretsFromEnv(t *testing.T) {
+	setSecrets(t, "", "", "", "from-flag")
+	t.Setenv("REVSOCKS_AUTH_TOKEN", "agent-token")
+	t.Setenv("REVSOCKS_TOR_PASSWORD", "from-env")
+
+	loadSecretsFromEnv()
+	if authToken != "agent-token" {
+		t.Fatalf("auth token = %q, want value from env", authToken)
+	}
+	if torPassword != "from-flag" {
+		t.Fatalf("tor password = %q, flag should win over env", torPassword)
+	}
+}
+
+// startAcceptLoop runs acceptAgents on a loopback listener and returns its
+// address. The loop is stopped and joined when the test ends.
+func startAcceptLoop(t *testing.T) string {
+	t.Helper()
+	setHealthConfig(t, time.Minute, time.Second, 1)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		acceptAgents(ln)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-stopped
+	})
+	return ln.Addr().String()
+}
+
+func dialAgent(t *testing.T, addr string, handshake ...[]byte) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial agent listener: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	for _, msg := range handshake {
+		writeAll(t, conn, msg)
+	}
+	return conn
+}
+
+// waitForAgent waits for the handler serving agentConn to be registered and
+// joins it once the test closes the agent.
+func waitForAgent(t *testing.T, agentConn net.Conn, within time.Duration) {
+	t.Helper()
+	agent, err := yamux.Server(agentConn, nil)
+	if err != nil {
+		t.Fatalf("failed to create agent session: %v", err)
+	}
+	t.Cleanup(func() { agent.Close() })
+
+	find := func() *ConnectionHandler {
+		for _, handler := range connections.Snapshot() {
+			if handler.conn.RemoteAddr().String() == agentConn.LocalAddr().String() {
+				return handler
+			}
+		}
+		return nil
+	}
+
+	deadline := time.Now().Add(within)
+	for {
+		if handler := find(); handler != nil {
+			t.Cleanup(func() {
+				agent.Close()
+				for find() != nil {
+					time.Sleep(10 * time.Millisecond)
+				}
+				handler.background.Wait()
+			})
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("agent was not registered within %v", within)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSilentAgentDoesNotBlockAcceptLoop(t *testing.T) {
+	addr := startAcceptLoop(t)
+
+	dialAgent(t, addr)
+	// Well under magicBytesTimeout, so the second agent must not wait behind
+	// the silent one's handshake.
+	waitForAgent(t, dialAgent(t, addr, MagicBytes), time.Second)
+}
+
+func TestSilentAgentDoesNotBlockTokenAuth(t *testing.T) {
+	const token = "agent-token"
+	setSecrets(t, token, "", "", "")
+	addr := startAcceptLoop(t)
+
+	// Sends the magic bytes and then stalls where the token should be.
+	dialAgent(t, addr, MagicBytes)
+	waitForAgent(t, dialAgent(t, addr, MagicBytes, authTokenFrame(token)), time.Second)
+}
@@ -7,8 +7,6 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 )
 
@@ -21,8 +19,7 @@ func NewDaemonClient() *Client {
 		client: &http.Client{
 			Transport: &http.Transport{
 				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-					sockPath := filepath.Join(os.TempDir(), "better-revsocks.sock")
-					return net.Dial("unix", sockPath)
+					return net.Dial("unix", daemonSocketPath())
 				},
 			},
 		},
@@ -30,8 +27,7 @@ func NewDaemonClient() *Client {
 }
 
 func (c *Client) call(method, path string, body io.Reader) ([]byte, error) {
-	path = "http://revsocks" + path
-	req, err := http.NewRequest(method, path, body)
+	req, err := http.NewRequest(method, "http://revsocks"+path, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -43,6 +39,12 @@ func (c *Client) call(method, path string, body io.Reader) ([]byte, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		if data, err := io.ReadAll(resp.Body); err == nil && json.Unmarshal(data, &errResp) == nil && errResp.Error != "" {
+			return nil, fmt.Errorf("%s failed: %s", path, errResp.Error)
+		}
 		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
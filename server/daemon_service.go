@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -11,19 +14,51 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+const daemonSocketName = "better-revsocks.sock"
+
+func daemonSocketPath() string {
+	return filepath.Join(os.TempDir(), daemonSocketName)
+}
+
 type DaemonService struct {
 	router   *gin.Engine
+	server   *http.Server
 	listener net.Listener
+	shutdown func() error
+	logger   *slog.Logger
+
+	// shutdownDone is closed once the server has finished shutting down,
+	// which is after the /shutdown response has been written.
+	shutdownDone chan struct{}
 }
 
-func NewDaemonService() *DaemonService {
-	return &DaemonService{
-		router: gin.Default(),
+// NewDaemonService creates the control plane. shutdown is called by the
+// /shutdown endpoint and its error is reported back to the caller.
+func NewDaemonService(shutdown func() error, logger *slog.Logger) *DaemonService {
+	gin.SetMode(gin.ReleaseMode)
+	d := &DaemonService{
+		router:       gin.New(),
+		shutdown:     shutdown,
+		logger:       logger.With("component", "daemon"),
+		shutdownDone: make(chan struct{}),
 	}
+	d.router.Use(d.logRequest, gin.Recovery())
+	d.server = &http.Server{Handler: d.router}
+	return d
+}
+
+func (d *DaemonService) logRequest(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	d.logger.Debug("Handled daemon request",
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"duration", time.Since(start))
 }
 
 func (d *DaemonService) Start() error {
-	sockPath := filepath.Join(os.TempDir(), "better-revsocks.sock")
+	sockPath := daemonSocketPath()
 	if err := os.Remove(sockPath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to remove existing socket file: %v", err)
 	}
@@ -36,7 +71,13 @@ func (d *DaemonService) Start() error {
 
 	d.setupRoutes()
 
-	return d.router.RunListener(d.listener)
+	if err := d.server.Serve(d.listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// Serve returns as soon as Shutdown starts; wait for it to finish so the
+	// caller of /shutdown gets the drain result before the process exits.
+	<-d.shutdownDone
+	return nil
 }
 
 func (d *DaemonService) setupRoutes() {
@@ -46,21 +87,28 @@ func (d *DaemonService) setupRoutes() {
 }
 
 func (d *DaemonService) shutdownHandler(c *gin.Context) {
-	c.Status(http.StatusOK)
+	err := d.shutdown()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	} else {
+		c.Status(http.StatusOK)
+	}
 	go func() {
-		time.Sleep(500 * time.Millisecond)
-		d.listener.Close()
-		os.Exit(0)
+		d.server.Shutdown(context.Background())
+		close(d.shutdownDone)
 	}()
 }
 
 func (d *DaemonService) connectionsHandler(c *gin.Context) {
-	infos := make([]ConnectionHandlerInfo, 0, len(connections))
-	for id, handler := range connections {
+	snapshot := connections.Snapshot()
+	infos := make([]ConnectionHandlerInfo, 0, len(snapshot))
+	for id, handler := range snapshot {
 		infos = append(infos, ConnectionHandlerInfo{
 			ID:         id,
 			IP:         handler.conn.RemoteAddr().(*net.TCPAddr).IP.String(),
 			ListenAddr: handler.socksClientListener.Addr().String(),
+			BytesIn:    handler.bytesIn.Load(),
+			BytesOut:   handler.bytesOut.Load(),
 		})
 	}
 	c.JSON(http.StatusOK, infos)
@@ -75,11 +123,12 @@ func (d *DaemonService) closeConnectionHandler(c *gin.Context) {
 		return
 	}
 
-	handler, ok := connections[req.ID]
+	handler, ok := connections.Get(req.ID)
 	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{"error": "connection not found"})
 		return
 	}
+	d.logger.Info("Closing connection on request", "agent_id", req.ID)
 	handler.Close()
 	c.Status(http.StatusOK)
 }
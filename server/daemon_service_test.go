@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestDaemon serves a DaemonService on a socket inside t.TempDir() and
+// returns a client connected to it together with the channel Start returns on.
+func startTestDaemon(t *testing.T, shutdown func() error) (*Client, <-chan error) {
+	t.Helper()
+	t.Setenv("TMPDIR", t.TempDir())
+
+	service := NewDaemonService(shutdown, logger)
+	started := make(chan error, 1)
+	go func() {
+		started <- service.Start()
+	}()
+
+	client := NewDaemonClient()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := client.ListConnections(); err == nil {
+			return client, started
+		} else if time.Now().After(deadline) {
+			t.Fatalf("daemon did not come up: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDaemonClientRoundTrip(t *testing.T) {
+	shutdownCalled := make(chan struct{})
+	client, started := startTestDaemon(t, func() error {
+		close(shutdownCalled)
+		return nil
+	})
+
+	infos, err := client.ListConnections()
+	if err != nil {
+		t.Fatalf("ListConnections: %v", err)
+	}
+	if len(infos) != 0 {
+		t.Fatalf("expected no connections, got %v", infos)
+	}
+
+	if err := client.Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case <-shutdownCalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown callback was not called")
+	}
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatalf("Start returned error after shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after shutdown")
+	}
+}
+
+func TestDaemonShutdownReportsDrainResult(t *testing.T) {
+	const drainTime = 200 * time.Millisecond
+	client, started := startTestDaemon(t, func() error {
+		time.Sleep(drainTime)
+		return errors.New("drain timed out")
+	})
+
+	start := time.Now()
+	err := client.Shutdown()
+	if err == nil || !strings.Contains(err.Error(), "drain timed out") {
+		t.Fatalf("got %v, want drain error", err)
+	}
+	if elapsed := time.Since(start); elapsed < drainTime {
+		t.Fatalf("Shutdown returned after %v, before the drain finished", elapsed)
+	}
+	if err := <-started; err != nil {
+		t.Fatalf("Start returned error after shutdown: %v", err)
+	}
+}
+
+func TestConnectionBandwidthReportedByDaemon(t *testing.T) {
+	setSocksCredentials(t, "", "")
+	client, _ := startTestDaemon(t, func() error { return nil })
+	handler, agent := newTestHandler(t)
+	id := generateConnectionID(handler.conn)
+	connections.Add(id, handler)
+
+	socksServer, socksClient := net.Pipe()
+	defer socksClient.Close()
+	go handler.establishServerConnection(socksServer)
+
+	const sent, received = 4096, 1500
+	go socksClient.Write(bytes.Repeat([]byte{'a'}, sent))
+	stream := acceptStream(t, agent)
+	defer stream.Close()
+	readExactly(t, stream, sent)
+
+	go stream.Write(bytes.Repeat([]byte{'b'}, received))
+	readExactly(t, socksClient, received)
+
+	// The stream is still open, so the totals must already be visible.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		infos, err := client.ListConnections()
+		if err != nil {
+			t.Fatalf("ListConnections: %v", err)
+		}
+		var info *ConnectionHandlerInfo
+		for i := range infos {
+			if infos[i].ID == id {
+				info = &infos[i]
+			}
+		}
+		if info == nil {
+			t.Fatalf("connection %s not listed", id)
+		}
+		if info.BytesOut == sent && info.BytesIn == received {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got bytes_in=%d bytes_out=%d, want %d/%d", info.BytesIn, info.BytesOut, received, sent)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,201 +1,496 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
-	"log"
+	"log/slog"
 	"math/big"
 	"net"
-	"reflect"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/yamux"
 )
 
+// Handshake read deadlines; variables so tests can shorten them.
 var (
-	MagicBytes = []byte{0x1b, 0xc3, 0xbd, 0x0f}
-	port       int
-	useTLS     bool
-	useTor     bool
+	magicBytesTimeout = 10 * time.Second
+	authTokenTimeout  = 10 * time.Second
 )
 
-var connections = make(map[string]*ConnectionHandler)
+var (
+	errSocksPortsExhausted = errors.New("no free port left in SOCKS port range")
+	errMagicBytesShortRead = errors.New("connection closed before magic bytes were received")
+	errMagicBytesMismatch  = errors.New("magic bytes mismatch")
+	errAuthTokenShortRead  = errors.New("connection closed before auth token was received")
+	errAuthTokenMismatch   = errors.New("auth token mismatch")
+)
+
+var (
+	MagicBytes     = []byte{0x1b, 0xc3, 0xbd, 0x0f}
+	port           int
+	useTLS         bool
+	useTor         bool
+	torControlAddr string
+	torPassword    string
+	authToken      string
+	tlsCertFile    string
+	tlsKeyFile     string
+	clientCAFile   string
+	socksUser      string
+	socksPass      string
+	socksBind      string
+	socksPort      int
+	socksPortRange string
+)
+
+var (
+	healthInterval    time.Duration
+	healthTimeout     time.Duration
+	healthMaxFailures int
+	drainTimeout      time.Duration
+)
+
+var connections = newConnectionRegistry()
+
+type connectionRegistry struct {
+	mu       sync.RWMutex
+	handlers map[string]*ConnectionHandler
+}
+
+func newConnectionRegistry() *connectionRegistry {
+	return &connectionRegistry{
+		handlers: make(map[string]*ConnectionHandler),
+	}
+}
+
+func (r *connectionRegistry) Add(id string, handler *ConnectionHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[id] = handler
+}
+
+func (r *connectionRegistry) Remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.handlers, id)
+}
+
+func (r *connectionRegistry) Get(id string) (*ConnectionHandler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	handler, ok := r.handlers[id]
+	return handler, ok
+}
+
+// Snapshot returns a copy of the registered handlers so callers can iterate
+// without holding the lock.
+func (r *connectionRegistry) Snapshot() map[string]*ConnectionHandler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	snapshot := make(map[string]*ConnectionHandler, len(r.handlers))
+	for id, handler := range r.handlers {
+		snapshot[id] = handler
+	}
+	return snapshot
+}
 
 type ConnectionHandler struct {
 	conn                net.Conn
 	socksClientListener net.Listener
 	session             *yamux.Session
 	healthChan          chan bool
+	bytesIn             atomic.Uint64
+	bytesOut            atomic.Uint64
+	copyMu              sync.Mutex
+	copies              sync.WaitGroup
+	background          sync.WaitGroup
+	draining            bool
+	logger              *slog.Logger
 }
 
 type ConnectionHandlerInfo struct {
 	ID         string `json:"id"`
 	IP         string `json:"ip"`
 	ListenAddr string `json:"listen_addr"`
+	BytesIn    uint64 `json:"bytes_in"`
+	BytesOut   uint64 `json:"bytes_out"`
 }
 
-func copyData(dst, src net.Conn) {
-	written, err := io.Copy(dst, src)
-	if err != nil {
-		log.Printf("Error copying data: %v", err)
+// countingWriter adds every successful write to counter so long-lived
+// streams are reflected in the totals while they are still open.
+type countingWriter struct {
+	w       io.Writer
+	counter *atomic.Uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.counter.Add(uint64(n))
+	return n, err
+}
+
+func (h *ConnectionHandler) copyData(dst, src net.Conn, counter *atomic.Uint64) {
+	defer h.copies.Done()
+	written, err := io.Copy(&countingWriter{w: dst, counter: counter}, src)
+	if err != nil && !isClosedConnError(err) {
+		h.logger.Warn("Error copying data", "error", err)
 	}
-	log.Printf("Copied %d bytes", written)
+	h.logger.Debug("Copied data", "bytes", written)
 	dst.Close()
 }
 
-func copyClientConnToServer(clientConn, serverConn net.Conn) {
-	log.Printf("Starting bidirectional copy between %v and %v", clientConn.RemoteAddr(), serverConn.RemoteAddr())
-	go copyData(clientConn, serverConn)
-	go copyData(serverConn, clientConn)
+// isClosedConnError reports errors that only mean the other side of a tunnel
+// already went away.
+func isClosedConnError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, yamux.ErrStreamClosed)
 }
 
-func NewConnectionHandler(conn net.Conn) *ConnectionHandler {
-	log.Printf("New connection handler created for connection from %v", conn.RemoteAddr())
-	id := generateConnectionID(conn)
-	connections[id] = &ConnectionHandler{
+func (h *ConnectionHandler) copyClientConnToServer(clientConn, serverConn net.Conn) {
+	h.copyMu.Lock()
+	defer h.copyMu.Unlock()
+	if h.draining {
+		h.logger.Info("Refusing client, connection is draining", "client_addr", clientConn.RemoteAddr().String())
+		clientConn.Close()
+		serverConn.Close()
+		return
+	}
+
+	h.logger.Debug("Starting bidirectional copy", "client_addr", clientConn.RemoteAddr().String())
+	h.copies.Add(2)
+	go h.copyData(clientConn, serverConn, &h.bytesIn)
+	go h.copyData(serverConn, clientConn, &h.bytesOut)
+}
+
+// Drain stops accepting SOCKS clients and blocks until every active copy has
+// finished. The session is left open so in-flight data can still flow.
+func (h *ConnectionHandler) Drain() {
+	h.copyMu.Lock()
+	h.draining = true
+	h.copyMu.Unlock()
+	h.socksClientListener.Close()
+	h.copies.Wait()
+}
+
+func (h *ConnectionHandler) isDraining() bool {
+	h.copyMu.Lock()
+	defer h.copyMu.Unlock()
+	return h.draining
+}
+
+func NewConnectionHandler(logger *slog.Logger, conn net.Conn) *ConnectionHandler {
+	logger = logger.With("agent_id", generateConnectionID(conn))
+	logger.Debug("New connection handler created")
+	return &ConnectionHandler{
 		conn:       conn,
-		healthChan: make(chan bool),
+		healthChan: make(chan bool, 1),
+		logger:     logger,
 	}
-	return connections[id]
 }
 
 func (h *ConnectionHandler) setupListener() error {
-	var listener net.Listener
-	var err error
-
-	listener, err = net.Listen("tcp", ":0")
+	listener, err := listenSocks(socksBind, socksPort, socksPortRange)
 	if err != nil {
-		log.Printf("Failed to create listener: %v", err)
 		return err
 	}
 
 	h.socksClientListener = listener
-	log.Printf("Listener started on %s (TLS: %v)", listener.Addr().String(), useTLS)
+	h.logger.Info("Listener started", "listen_addr", listener.Addr().String(), "tls", useTLS)
 	return nil
 }
 
+// listenSocks binds the per-agent SOCKS listener on bind, using fixedPort if
+// set, otherwise the first free port in portRange, otherwise a random port.
+func listenSocks(bind string, fixedPort int, portRange string) (net.Listener, error) {
+	if fixedPort != 0 {
+		return net.Listen("tcp", net.JoinHostPort(bind, strconv.Itoa(fixedPort)))
+	}
+	if portRange == "" {
+		return net.Listen("tcp", net.JoinHostPort(bind, "0"))
+	}
+
+	first, last, err := parsePortRange(portRange)
+	if err != nil {
+		return nil, err
+	}
+	for p := first; p <= last; p++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort(bind, strconv.Itoa(p)))
+		if err == nil {
+			return listener, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errSocksPortsExhausted, portRange)
+}
+
+func parsePortRange(portRange string) (int, int, error) {
+	firstStr, lastStr, ok := strings.Cut(portRange, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port range %q, expected <first>-<last>", portRange)
+	}
+	first, err := strconv.Atoi(strings.TrimSpace(firstStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range start %q: %v", firstStr, err)
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(lastStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range end %q: %v", lastStr, err)
+	}
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("invalid port range %q", portRange)
+	}
+	return first, last, nil
+}
+
 func (h *ConnectionHandler) setupYamuxSession() error {
-	log.Printf("Setting up yamux session for connection from %v", h.conn.RemoteAddr())
+	h.logger.Debug("Setting up yamux session")
 	session, err := yamux.Client(h.conn, nil)
 	if err != nil {
-		log.Printf("Failed to create yamux client: %v", err)
 		return err
 	}
 	h.session = session
-	log.Printf("Yamux session established successfully")
+	h.logger.Debug("Yamux session established successfully")
 	return nil
 }
 
+// monitorHealth pings the agent right away and then every healthInterval.
+// Since healthTimeout never exceeds the interval, a dead agent is reported
+// within healthInterval*healthMaxFailures. A closed session is reported
+// immediately.
 func (h *ConnectionHandler) monitorHealth() {
-	log.Printf("Starting health monitor for connection from %v", h.conn.RemoteAddr())
-	ticker := time.NewTicker(5 * time.Second)
+	h.logger.Debug("Starting health monitor")
+	ticker := time.NewTicker(healthInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		if _, err := h.session.Ping(); err != nil {
-			log.Printf("Health check failed: %v", err)
+	failures := 0
+	for {
+		if err := h.ping(); err != nil {
+			if h.session.IsClosed() {
+				h.healthChan <- false
+				return
+			}
+			failures++
+			h.logger.Warn("Health check failed", "failures", failures, "max_failures", healthMaxFailures, "error", err)
+			if failures >= healthMaxFailures {
+				h.healthChan <- false
+				return
+			}
+		} else {
+			h.logger.Debug("Health check succeeded")
+			failures = 0
+		}
+
+		select {
+		case <-ticker.C:
+		case <-h.session.CloseChan():
 			h.healthChan <- false
 			return
 		}
 	}
 }
 
+// ping bounds session.Ping by healthTimeout so a stalled session is detected
+// instead of blocking the monitor indefinitely.
+func (h *ConnectionHandler) ping() error {
+	result := make(chan error, 1)
+	go func() {
+		_, err := h.session.Ping()
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(healthTimeout):
+		return fmt.Errorf("ping timed out after %v", healthTimeout)
+	}
+}
+
 func (h *ConnectionHandler) handleClientConnection() error {
-	acceptChan := make(chan net.Conn)
-	errChan := make(chan error)
+	acceptChan := make(chan net.Conn, 1)
+	errChan := make(chan error, 1)
 
 	go func() {
-		log.Printf("Waiting for client connection on %v", h.socksClientListener.Addr())
+		h.logger.Debug("Waiting for client connection", "listen_addr", h.socksClientListener.Addr().String())
 		clientConn, err := h.socksClientListener.Accept()
 		if err != nil {
-			log.Printf("Failed to accept client connection: %v", err)
 			errChan <- err
 		} else {
-			log.Printf("Accepted client connection from %v", clientConn.RemoteAddr())
+			h.logger.Debug("Accepted client connection", "client_addr", clientConn.RemoteAddr().String())
 			acceptChan <- clientConn
 		}
 	}()
 
 	select {
 	case <-h.healthChan:
-		log.Printf("Connection health check failed")
+		return io.EOF
+	case <-h.session.CloseChan():
 		return io.EOF
 	case clientConn := <-acceptChan:
-		return h.establishServerConnection(clientConn)
+		h.background.Add(1)
+		go func() {
+			defer h.background.Done()
+			h.establishServerConnection(clientConn)
+		}()
+		return nil
 	case err := <-errChan:
 		return err
 	}
 }
 
-func (h *ConnectionHandler) establishServerConnection(clientConn net.Conn) error {
-	log.Printf("Opening new yamux stream for client %v", clientConn.RemoteAddr())
+// establishServerConnection runs in its own goroutine per client so a slow
+// SOCKS negotiation does not hold up the accept loop.
+func (h *ConnectionHandler) establishServerConnection(clientConn net.Conn) {
+	authRequired := socksUser != "" || socksPass != ""
+	if authRequired {
+		if err := negotiateSocksAuth(clientConn, socksUser, socksPass); err != nil {
+			h.logger.Warn("SOCKS authentication failed", "client_addr", clientConn.RemoteAddr().String(), "error", err)
+			clientConn.Close()
+			return
+		}
+	}
+
+	h.logger.Debug("Opening new yamux stream", "client_addr", clientConn.RemoteAddr().String())
 	serverConn, err := h.session.Open()
 	if err != nil {
-		log.Printf("Failed to open yamux stream: %v", err)
+		h.logger.Warn("Failed to open yamux stream", "error", err)
 		clientConn.Close()
-		return err
+		return
 	}
-	log.Printf("Successfully opened yamux stream")
-	go copyClientConnToServer(clientConn, serverConn)
-	return nil
+	h.logger.Debug("Successfully opened yamux stream")
+
+	if authRequired {
+		if err := greetSocksAgent(serverConn); err != nil {
+			h.logger.Warn("SOCKS greeting with agent failed", "error", err)
+			serverConn.Close()
+			clientConn.Close()
+			return
+		}
+	}
+	h.copyClientConnToServer(clientConn, serverConn)
 }
 
 func (h *ConnectionHandler) Close() {
-	delete(connections, generateConnectionID(h.conn))
+	connections.Remove(generateConnectionID(h.conn))
 	h.session.Close()
 	h.conn.Close()
 	h.socksClientListener.Close()
 }
 
-func handleConnection(conn net.Conn) {
-	log.Printf("Handling new connection from %v", conn.RemoteAddr())
-	handler := NewConnectionHandler(conn)
+func handleConnection(logger *slog.Logger, conn net.Conn) {
+	handler := NewConnectionHandler(logger, conn)
+	logger = handler.logger
+	logger.Debug("Handling new connection")
+	// Joins the health monitor and client goroutines once the session is closed.
+	defer handler.background.Wait()
 
 	if err := handler.setupListener(); err != nil {
-		log.Printf("Error creating listener: %s", err)
+		logger.Warn("Error creating listener, refusing agent", "error", err)
+		conn.Close()
 		return
 	}
 	defer handler.socksClientListener.Close()
 
 	if err := handler.setupYamuxSession(); err != nil {
-		log.Printf("Error creating yamux client: %s", err)
+		logger.Warn("Error creating yamux client", "error", err)
 		return
 	}
 	defer handler.session.Close()
 
-	go handler.monitorHealth()
+	id := generateConnectionID(conn)
+	connections.Add(id, handler)
+	defer connections.Remove(id)
+
+	handler.background.Add(1)
+	go func() {
+		defer handler.background.Done()
+		handler.monitorHealth()
+	}()
 
 	for {
 		if err := handler.handleClientConnection(); err != nil {
-			if err == io.EOF {
-				log.Printf("Connection closed from %v", conn.RemoteAddr())
+			if handler.isDraining() {
+				// Keep the session up until the drain finishes or force-closes it.
+				handler.copies.Wait()
+			}
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				logger.Info("Connection closed")
 			} else {
-				log.Printf("Error handling connection from %v: %s", conn.RemoteAddr(), err)
+				logger.Warn("Error handling connection", "error", err)
 			}
 			return
 		}
 	}
 }
 
-func validateMagicBytes(conn net.Conn) error {
-	log.Printf("Validating magic bytes from %v", conn.RemoteAddr())
+func validateMagicBytes(logger *slog.Logger, conn net.Conn) error {
+	logger.Debug("Validating magic bytes")
+	if err := conn.SetReadDeadline(time.Now().Add(magicBytesTimeout)); err != nil {
+		return fmt.Errorf("failed to set read deadline: %v", err)
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
 	magic := make([]byte, len(MagicBytes))
-	if _, err := conn.Read(magic); err != nil {
-		log.Printf("Failed to read magic bytes: %v", err)
+	if _, err := io.ReadFull(conn, magic); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errMagicBytesShortRead
+		}
 		return err
 	}
-	if !reflect.DeepEqual(magic, MagicBytes) {
-		log.Printf("Invalid magic bytes received: %v", magic)
-		return io.EOF
+	if !bytes.Equal(magic, MagicBytes) {
+		logger.Debug("Invalid magic bytes received", "magic", fmt.Sprintf("%x", magic))
+		return errMagicBytesMismatch
+	}
+	logger.Debug("Magic bytes validated successfully")
+	return nil
+}
+
+// validateAuthToken reads a token prefixed by its big-endian uint16 length
+// and compares it with token in constant time.
+func validateAuthToken(logger *slog.Logger, conn net.Conn, token string) error {
+	logger.Debug("Validating auth token")
+	if err := conn.SetReadDeadline(time.Now().Add(authTokenTimeout)); err != nil {
+		return fmt.Errorf("failed to set read deadline: %v", err)
 	}
-	log.Printf("Magic bytes validated successfully")
+	defer conn.SetReadDeadline(time.Time{})
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errAuthTokenShortRead
+		}
+		return err
+	}
+
+	received := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errAuthTokenShortRead
+		}
+		return err
+	}
+	if subtle.ConstantTimeCompare(received, []byte(token)) != 1 {
+		return errAuthTokenMismatch
+	}
+	logger.Debug("Auth token validated successfully")
 	return nil
 }
 
@@ -206,17 +501,69 @@ func generateConnectionID(conn net.Conn) string {
 	return fmt.Sprintf("%x", h.Sum32())
 }
 
+func loadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	var err error
+	if certFile == "" && keyFile == "" {
+		tlsConfig, err = generateTLSConfig()
+	} else {
+		tlsConfig, err = loadTLSKeyPair(certFile, keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in client CA %s", caFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func loadTLSKeyPair(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both TLS certificate and key must be provided")
+	}
+	tlsCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS key pair: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+	}, nil
+}
+
 func generateTLSConfig() (*tls.Config, error) {
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate private key: %v", err)
 	}
 
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	dnsNames := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		dnsNames = append(dnsNames, hostname)
+	}
+
 	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
+		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Organization: []string{"Self-Signed Cert"},
 		},
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// newTestHandler builds a ConnectionHandler backed by a real loopback TCP
+// connection with a yamux session on both ends. The returned session is the
+// agent side, which accepts the streams the handler opens.
+func newTestHandler(t *testing.T) (*ConnectionHandler, *yamux.Session) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	agentConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	serverConn, ok := <-accepted
+	if !ok {
+		t.Fatal("failed to accept test connection")
+	}
+
+	agentSession, err := yamux.Server(agentConn, nil)
+	if err != nil {
+		t.Fatalf("failed to create agent session: %v", err)
+	}
+
+	handler := NewConnectionHandler(logger, serverConn)
+	if err := handler.setupYamuxSession(); err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+	handler.socksClientListener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create socks listener: %v", err)
+	}
+
+	t.Cleanup(func() {
+		handler.Close()
+		agentSession.Close()
+	})
+	return handler, agentSession
+}
+
+func TestConnectionRegistryConcurrentAccess(t *testing.T) {
+	daemon := NewDaemonService(nil, logger)
+	daemon.setupRoutes()
+
+	const agents = 8
+	handlers := make([]*ConnectionHandler, agents)
+	for i := range handlers {
+		handlers[i], _ = newTestHandler(t)
+	}
+
+	var wg sync.WaitGroup
+	for i, handler := range handlers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := generateConnectionID(handler.conn)
+			connections.Add(id, handler)
+			if _, ok := connections.Get(id); !ok {
+				t.Errorf("handler %s missing after Add", id)
+			}
+
+			if i%2 == 0 {
+				handler.Close()
+				return
+			}
+			body := strings.NewReader(fmt.Sprintf(`{"id": "%s"}`, id))
+			rec := httptest.NewRecorder()
+			daemon.router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/close", body))
+			if rec.Code != http.StatusOK {
+				t.Errorf("close %s: unexpected status %d", id, rec.Code)
+			}
+		}()
+	}
+
+	for range agents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			daemon.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/connections", nil))
+			var infos []ConnectionHandlerInfo
+			if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+				t.Errorf("invalid /connections response: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, handler := range handlers {
+		if _, ok := connections.Get(generateConnectionID(handler.conn)); ok {
+			t.Errorf("handler %s still registered after Close", generateConnectionID(handler.conn))
+		}
+	}
+}
+
+// pipeConn adapts an io.Pipe reader to net.Conn so tests can control exactly
+// how the handshake bytes arrive.
+type pipeConn struct {
+	net.Conn
+	r *io.PipeReader
+}
+
+func (c *pipeConn) Read(p []byte) (int, error)      { return c.r.Read(p) }
+func (c *pipeConn) SetReadDeadline(time.Time) error { return nil }
+func (c *pipeConn) RemoteAddr() net.Addr            { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+// feedPipe writes each chunk separately and then closes the pipe.
+func feedPipe(chunks ...[]byte) net.Conn {
+	r, w := io.Pipe()
+	go func() {
+		for _, chunk := range chunks {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+		w.Close()
+	}()
+	return &pipeConn{r: r}
+}
+
+func splitBytes(b []byte) [][]byte {
+	chunks := make([][]byte, len(b))
+	for i := range b {
+		chunks[i] = b[i : i+1]
+	}
+	return chunks
+}
+
+func TestValidateMagicBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		want   error
+	}{
+		{"one byte at a time", splitBytes(MagicBytes), nil},
+		{"two segments", [][]byte{MagicBytes[:2], MagicBytes[2:]}, nil},
+		{"truncated", splitBytes(MagicBytes[:3]), errMagicBytesShortRead},
+		{"empty", nil, errMagicBytesShortRead},
+		{"mismatch", splitBytes([]byte{0x1b, 0xc3, 0xbd, 0x00}), errMagicBytesMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMagicBytes(logger, feedPipe(tt.chunks...))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateMagicBytesDeadline(t *testing.T) {
+	old := magicBytesTimeout
+	magicBytesTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { magicBytesTimeout = old })
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	start := time.Now()
+	err := validateMagicBytes(logger, server)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("deadline fired after %v", elapsed)
+	}
+}
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert issues a certificate for template, signed by parent or
+// self-signed when parent is nil.
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signerCert, signerKey := template, key
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func newTestCA(t *testing.T, name string) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+}
+
+func newTestLeaf(t *testing.T, name string, usage x509.ExtKeyUsage, ca *testCert) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}, ca)
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestLoadTLSConfigKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test ca")
+	server := newTestLeaf(t, "server", x509.ExtKeyUsageServerAuth, ca)
+	other := newTestLeaf(t, "other", x509.ExtKeyUsageServerAuth, ca)
+
+	certFile := writeTestFile(t, dir, "server.crt", server.certPEM)
+	keyFile := writeTestFile(t, dir, "server.key", server.keyPEM)
+	otherKeyFile := writeTestFile(t, dir, "other.key", other.keyPEM)
+
+	tlsConfig, err := loadTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("failed to load key pair: %v", err)
+	}
+	if len(tlsConfig.Certificates) != 1 || tlsConfig.ClientAuth != tls.NoClientCert {
+		t.Fatalf("unexpected TLS config: %+v", tlsConfig)
+	}
+
+	if _, err := loadTLSConfig(certFile, otherKeyFile, ""); err == nil {
+		t.Fatal("expected mismatched key pair to be rejected")
+	}
+	if _, err := loadTLSConfig(certFile, "", ""); err == nil {
+		t.Fatal("expected certificate without key to be rejected")
+	}
+}
+
+func TestGenerateTLSConfigHasSAN(t *testing.T) {
+	tlsConfig, err := generateTLSConfig()
+	if err != nil {
+		t.Fatalf("failed to generate TLS config: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse generated certificate: %v", err)
+	}
+	if err := leaf.VerifyHostname("localhost"); err != nil {
+		t.Fatalf("generated certificate not valid for localhost: %v", err)
+	}
+}
+
+func TestLoadTLSConfigClientCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "agent ca")
+	rogueCA := newTestCA(t, "rogue ca")
+	server := newTestLeaf(t, "server", x509.ExtKeyUsageServerAuth, ca)
+	trusted := newTestLeaf(t, "trusted agent", x509.ExtKeyUsageClientAuth, ca)
+	untrusted := newTestLeaf(t, "untrusted agent", x509.ExtKeyUsageClientAuth, rogueCA)
+
+	tlsConfig, err := loadTLSConfig(
+		writeTestFile(t, dir, "server.crt", server.certPEM),
+		writeTestFile(t, dir, "server.key", server.keyPEM),
+		writeTestFile(t, dir, "ca.crt", ca.certPEM),
+	)
+	if err != nil {
+		t.Fatalf("failed to load TLS config: %v", err)
+	}
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("client certs not required: %v", tlsConfig.ClientAuth)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+				conn.Write([]byte{0})
+			}()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(agent *testCert) error {
+		config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if agent != nil {
+			pair, err := tls.X509KeyPair(agent.certPEM, agent.keyPEM)
+			if err != nil {
+				t.Fatalf("failed to build client key pair: %v", err)
+			}
+			config.Certificates = []tls.Certificate{pair}
+		}
+		conn, err := tls.Dial("tcp", ln.Addr().String(), config)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// With TLS 1.3 a rejected client cert only surfaces on the first read.
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+
+	if err := dial(trusted); err != nil {
+		t.Fatalf("trusted agent rejected: %v", err)
+	}
+	if err := dial(untrusted); err == nil {
+		t.Fatal("agent signed by another CA was accepted")
+	}
+	if err := dial(nil); err == nil {
+		t.Fatal("agent without certificate was accepted")
+	}
+}
+
+// freePortRange reserves n consecutive free loopback ports and returns the
+// first one. The listeners are closed before returning.
+func freePortRange(t *testing.T, n int) int {
+	t.Helper()
+	for attempt := 0; attempt < 50; attempt++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		first := ln.Addr().(*net.TCPAddr).Port
+		held := []net.Listener{ln}
+		for p := first + 1; p < first+n; p++ {
+			l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(p)))
+			if err != nil {
+				break
+			}
+			held = append(held, l)
+		}
+		for _, l := range held {
+			l.Close()
+		}
+		if len(held) == n {
+			return first
+		}
+	}
+	t.Fatalf("could not find %d consecutive free ports", n)
+	return 0
+}
+
+func TestListenSocksFixedPort(t *testing.T) {
+	port := freePortRange(t, 1)
+
+	ln, err := listenSocks("127.0.0.1", port, "")
+	if err != nil {
+		t.Fatalf("failed to bind fixed port: %v", err)
+	}
+	defer ln.Close()
+	if got := ln.Addr().(*net.TCPAddr).Port; got != port {
+		t.Fatalf("bound port %d, want %d", got, port)
+	}
+
+	if _, err := listenSocks("127.0.0.1", port, ""); err == nil {
+		t.Fatal("expected second bind on the fixed port to fail")
+	}
+}
+
+func TestListenSocksRange(t *testing.T) {
+	first := freePortRange(t, 3)
+	portRange := fmt.Sprintf("%d-%d", first, first+2)
+
+	var listeners []net.Listener
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		ln, err := listenSocks("127.0.0.1", 0, portRange)
+		if err != nil {
+			t.Fatalf("bind %d in range %s failed: %v", i, portRange, err)
+		}
+		if got := ln.Addr().(*net.TCPAddr).Port; got != first+i {
+			t.Fatalf("bind %d got port %d, want %d", i, got, first+i)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	if _, err := listenSocks("127.0.0.1", 0, portRange); !errors.Is(err, errSocksPortsExhausted) {
+		t.Fatalf("got %v, want %v", err, errSocksPortsExhausted)
+	}
+}
+
+func TestListenSocksBadBindNotExhausted(t *testing.T) {
+	first := freePortRange(t, 2)
+	// 192.0.2.1 (TEST-NET-1) is not assigned locally, so binding fails for a
+	// reason other than the port being taken.
+	_, err := listenSocks("192.0.2.1", 0, fmt.Sprintf("%d-%d", first, first+1))
+	if err == nil {
+		t.Fatal("expected bind on an unassigned address to fail")
+	}
+	if errors.Is(err, errSocksPortsExhausted) {
+		t.Fatalf("bind error reported as port exhaustion: %v", err)
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in          string
+		first, last int
+		wantErr     bool
+	}{
+		{"20000-20100", 20000, 20100, false},
+		{"20000 - 20000", 20000, 20000, false},
+		{"20100-20000", 0, 0, true},
+		{"0-10", 0, 0, true},
+		{"1-65536", 0, 0, true},
+		{"20000", 0, 0, true},
+		{"a-b", 0, 0, true},
+	}
+	for _, tt := range tests {
+		first, last, err := parsePortRange(tt.in)
+		if (err != nil) != tt.wantErr || first != tt.first || last != tt.last {
+			t.Errorf("parsePortRange(%q) = %d, %d, %v", tt.in, first, last, err)
+		}
+	}
+}
+
+// pipeRWC joins two io.Pipe halves into the ReadWriteCloser yamux expects.
+type pipeRWC struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func (p *pipeRWC) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *pipeRWC) Write(b []byte) (int, error) { return p.w.Write(b) }
+func (p *pipeRWC) Close() error {
+	p.r.Close()
+	return p.w.Close()
+}
+
+func newPipePair() (*pipeRWC, *pipeRWC) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return &pipeRWC{r: r1, w: w2}, &pipeRWC{r: r2, w: w1}
+}
+
+func setHealthConfig(t *testing.T, interval, timeout time.Duration, maxFailures int) {
+	t.Helper()
+	oldInterval, oldTimeout, oldFailures := healthInterval, healthTimeout, healthMaxFailures
+	healthInterval, healthTimeout, healthMaxFailures = interval, timeout, maxFailures
+	t.Cleanup(func() {
+		healthInterval, healthTimeout, healthMaxFailures = oldInterval, oldTimeout, oldFailures
+	})
+}
+
+func waitForHealthFailure(t *testing.T, handler *ConnectionHandler, within time.Duration) {
+	t.Helper()
+	select {
+	case <-handler.healthChan:
+	case <-time.After(within):
+		t.Fatalf("health failure not reported within %v", within)
+	}
+}
+
+func TestMonitorHealthDetectsClosedSession(t *testing.T) {
+	const interval, maxFailures = 50 * time.Millisecond, 3
+	setHealthConfig(t, interval, interval, maxFailures)
+
+	serverSide, agentSide := newPipePair()
+	agent, err := yamux.Server(agentSide, nil)
+	if err != nil {
+		t.Fatalf("failed to create agent session: %v", err)
+	}
+	session, err := yamux.Client(serverSide, nil)
+	if err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+	defer session.Close()
+
+	handler := &ConnectionHandler{session: session, healthChan: make(chan bool, 1), logger: logger}
+	go handler.monitorHealth()
+
+	// A healthy agent must not be reported.
+	select {
+	case <-handler.healthChan:
+		t.Fatal("healthy session reported as failed")
+	case <-time.After(3 * interval):
+	}
+
+	agent.Close()
+	agentSide.Close()
+	waitForHealthFailure(t, handler, interval*maxFailures+interval)
+}
+
+func TestMonitorHealthDetectsStalledSession(t *testing.T) {
+	const interval, maxFailures = 50 * time.Millisecond, 2
+	setHealthConfig(t, interval, interval/2, maxFailures)
+
+	// Nothing ever reads the other end, so pings stall instead of failing.
+	serverSide, agentSide := newPipePair()
+	defer agentSide.Close()
+	session, err := yamux.Client(serverSide, nil)
+	if err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+	defer session.Close()
+
+	handler := &ConnectionHandler{session: session, healthChan: make(chan bool, 1), logger: logger}
+	go handler.monitorHealth()
+
+	waitForHealthFailure(t, handler, interval*maxFailures)
+}
+
+func authTokenFrame(token string) []byte {
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(token)))
+	return append(frame, token...)
+}
+
+func TestValidateAuthToken(t *testing.T) {
+	const expected = "correct horse battery"
+	good := authTokenFrame(expected)
+
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		want   error
+	}{
+		{"good token", [][]byte{good}, nil},
+		{"good token one byte at a time", splitBytes(good), nil},
+		{"bad token", [][]byte{authTokenFrame("correct horse battery!")}, errAuthTokenMismatch},
+		{"same length bad token", [][]byte{authTokenFrame("correct horse batterx")}, errAuthTokenMismatch},
+		{"empty token", [][]byte{authTokenFrame("")}, errAuthTokenMismatch},
+		{"truncated token", [][]byte{good[:len(good)-3]}, errAuthTokenShortRead},
+		{"truncated length", [][]byte{good[:1]}, errAuthTokenShortRead},
+		{"nothing sent", nil, errAuthTokenShortRead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			testLogger, err := newLogger(&out, "debug", "text")
+			if err != nil {
+				t.Fatalf("newLogger: %v", err)
+			}
+
+			err = validateAuthToken(testLogger, feedPipe(tt.chunks...), expected)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil && strings.Contains(err.Error(), expected) {
+				t.Fatalf("error leaks expected token: %v", err)
+			}
+			if strings.Contains(out.String(), expected) {
+				t.Fatalf("log leaks expected token: %s", out.String())
+			}
+		})
+	}
+}
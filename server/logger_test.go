@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLoggerRejectsInvalidOptions(t *testing.T) {
+	var out bytes.Buffer
+	if _, err := newLogger(&out, "verbose", "text"); err == nil {
+		t.Fatal("expected invalid level to be rejected")
+	}
+	if _, err := newLogger(&out, "info", "xml"); err == nil {
+		t.Fatal("expected invalid format to be rejected")
+	}
+}
+
+// observingHandler passes records through to inner while reporting every
+// message it sees, whatever its level, so tests can tell a suppressed line
+// from one that was never logged.
+type observingHandler struct {
+	inner slog.Handler
+	seen  chan<- string
+}
+
+func (h *observingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *observingHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	if h.inner.Enabled(ctx, r.Level) {
+		err = h.inner.Handle(ctx, r)
+	}
+	select {
+	case h.seen <- r.Message:
+	default:
+	}
+	return err
+}
+
+func (h *observingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &observingHandler{inner: h.inner.WithAttrs(attrs), seen: h.seen}
+}
+
+func (h *observingHandler) WithGroup(name string) slog.Handler {
+	return &observingHandler{inner: h.inner.WithGroup(name), seen: h.seen}
+}
+
+func waitForLog(t *testing.T, seen <-chan string, msg string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case got := <-seen:
+			if got == msg {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("%q was never logged", msg)
+		}
+	}
+}
+
+func TestInfoLevelSuppressesPerCopyAndPingLogs(t *testing.T) {
+	setSocksCredentials(t, "", "")
+	setHealthConfig(t, time.Minute, time.Second, 1)
+
+	var out bytes.Buffer
+	infoLogger, err := newLogger(&out, "info", "text")
+	if err != nil {
+		t.Fatalf("newLogger: %v", err)
+	}
+	seen := make(chan string, 256)
+	testLogger := slog.New(&observingHandler{inner: infoLogger.Handler(), seen: seen})
+
+	listenerHandler := NewConnectionHandler(testLogger, feedPipe())
+	if err := listenerHandler.setupListener(); err != nil {
+		t.Fatalf("setupListener: %v", err)
+	}
+	listenerHandler.socksClientListener.Close()
+	waitForLog(t, seen, "Listener started")
+
+	handler, agent := newTestHandler(t)
+	handler.logger = testLogger
+
+	// Push a tunnel through a real copy in both directions.
+	server, client := net.Pipe()
+	go handler.establishServerConnection(server)
+	greeting := socksGreeting(socksMethodNoAuth)
+	go client.Write(greeting)
+	stream := acceptStream(t, agent)
+	readExactly(t, stream, len(greeting))
+	client.Close()
+	stream.Close()
+	waitForLog(t, seen, "Copied data")
+	handler.copies.Wait()
+
+	// The monitor pings as soon as it starts.
+	monitorDone := make(chan struct{})
+	go func() {
+		handler.monitorHealth()
+		close(monitorDone)
+	}()
+	waitForLog(t, seen, "Health check succeeded")
+	handler.session.Close()
+	<-monitorDone
+
+	for _, msg := range []string{"Copied data", "Health check succeeded"} {
+		if strings.Contains(out.String(), msg) {
+			t.Fatalf("%q written at info level:\n%s", msg, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "Listener started") {
+		t.Fatalf("info line missing:\n%s", out.String())
+	}
+}
+
+func TestHandlerJSONLogFields(t *testing.T) {
+	var out bytes.Buffer
+	testLogger, err := newLogger(&out, "info", "json")
+	if err != nil {
+		t.Fatalf("newLogger: %v", err)
+	}
+
+	conn := feedPipe()
+	connLogger := testLogger.With("remote_addr", conn.RemoteAddr().String())
+	handler := NewConnectionHandler(connLogger, conn)
+	if err := handler.setupListener(); err != nil {
+		t.Fatalf("setupListener: %v", err)
+	}
+	defer handler.socksClientListener.Close()
+
+	var entry map[string]any
+	line, _, _ := strings.Cut(out.String(), "\n")
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("invalid JSON log line %q: %v", line, err)
+	}
+	if entry["msg"] != "Listener started" {
+		t.Fatalf("unexpected first log line: %v", entry)
+	}
+	if entry["agent_id"] != generateConnectionID(conn) {
+		t.Fatalf("agent_id = %v, want %s", entry["agent_id"], generateConnectionID(conn))
+	}
+	if entry["remote_addr"] != conn.RemoteAddr().String() {
+		t.Fatalf("remote_addr = %v, want %s", entry["remote_addr"], conn.RemoteAddr())
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	socksVersion          = 0x05
+	socksAuthVersion      = 0x01
+	socksMethodNoAuth     = 0x00
+	socksMethodUserPass   = 0x02
+	socksMethodNoAccepted = 0xff
+	socksAuthSuccess      = 0x00
+	socksAuthFailure      = 0x01
+)
+
+// socksAuthTimeout bounds each SOCKS negotiation; a variable so tests can
+// shorten it.
+var socksAuthTimeout = 10 * time.Second
+
+var (
+	errSocksVersion        = errors.New("unsupported SOCKS version")
+	errSocksNoAcceptable   = errors.New("client offered no acceptable authentication method")
+	errSocksAuthVersion    = errors.New("unsupported username/password auth version")
+	errSocksAuthFailed     = errors.New("invalid SOCKS credentials")
+	errSocksAgentHandshake = errors.New("agent rejected SOCKS greeting")
+)
+
+// negotiateSocksAuth performs the SOCKS5 greeting and RFC 1929
+// username/password sub-negotiation with a connecting client.
+func negotiateSocksAuth(conn net.Conn, user, pass string) error {
+	if err := conn.SetDeadline(time.Now().Add(socksAuthTimeout)); err != nil {
+		return fmt.Errorf("failed to set deadline: %v", err)
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read greeting: %v", err)
+	}
+	if header[0] != socksVersion {
+		return errSocksVersion
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("failed to read auth methods: %v", err)
+	}
+
+	offered := false
+	for _, method := range methods {
+		if method == socksMethodUserPass {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksMethodNoAccepted})
+		return errSocksNoAcceptable
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksMethodUserPass}); err != nil {
+		return fmt.Errorf("failed to write method selection: %v", err)
+	}
+
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return fmt.Errorf("failed to read auth version: %v", err)
+	}
+	if version[0] != socksAuthVersion {
+		conn.Write([]byte{socksAuthVersion, socksAuthFailure})
+		return errSocksAuthVersion
+	}
+
+	gotUser, err := readSocksAuthField(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read username: %v", err)
+	}
+	gotPass, err := readSocksAuthField(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read password: %v", err)
+	}
+
+	userOK := subtle.ConstantTimeCompare(gotUser, []byte(user))
+	passOK := subtle.ConstantTimeCompare(gotPass, []byte(pass))
+	if userOK&passOK != 1 {
+		conn.Write([]byte{socksAuthVersion, socksAuthFailure})
+		return errSocksAuthFailed
+	}
+	if _, err := conn.Write([]byte{socksAuthVersion, socksAuthSuccess}); err != nil {
+		return fmt.Errorf("failed to write auth status: %v", err)
+	}
+	return nil
+}
+
+func readSocksAuthField(conn net.Conn) ([]byte, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	field := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, field); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+// greetSocksAgent replays a no-auth greeting to the agent after the server
+// has already authenticated the client itself.
+func greetSocksAgent(stream net.Conn) error {
+	if err := stream.SetDeadline(time.Now().Add(socksAuthTimeout)); err != nil {
+		return fmt.Errorf("failed to set deadline: %v", err)
+	}
+	defer stream.SetDeadline(time.Time{})
+
+	if _, err := stream.Write([]byte{socksVersion, 0x01, socksMethodNoAuth}); err != nil {
+		return fmt.Errorf("failed to write agent greeting: %v", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(stream, reply); err != nil {
+		return fmt.Errorf("failed to read agent greeting reply: %v", err)
+	}
+	if reply[0] != socksVersion || reply[1] != socksMethodNoAuth {
+		return errSocksAgentHandshake
+	}
+	return nil
+}
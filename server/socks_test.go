@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+func socksGreeting(methods ...byte) []byte {
+	return append([]byte{socksVersion, byte(len(methods))}, methods...)
+}
+
+func socksUserPass(user, pass string) []byte {
+	msg := []byte{socksAuthVersion, byte(len(user))}
+	msg = append(msg, user...)
+	msg = append(msg, byte(len(pass)))
+	return append(msg, pass...)
+}
+
+func setSocksCredentials(t *testing.T, user, pass string) {
+	t.Helper()
+	oldUser, oldPass := socksUser, socksPass
+	socksUser, socksPass = user, pass
+	t.Cleanup(func() { socksUser, socksPass = oldUser, oldPass })
+}
+
+func writeAll(t *testing.T, conn net.Conn, msg []byte) {
+	t.Helper()
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+}
+
+func readExactly(t *testing.T, conn net.Conn, n int) []byte {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return buf
+}
+
+func acceptStream(t *testing.T, session *yamux.Session) net.Conn {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		stream, err := session.Accept()
+		if err == nil {
+			accepted <- stream
+		}
+	}()
+	select {
+	case stream := <-accepted:
+		return stream
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not receive a stream")
+		return nil
+	}
+}
+
+func TestNegotiateSocksAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		methods  []byte
+		user     string
+		pass     string
+		wantErr  error
+		wantAuth []byte
+	}{
+		{"good credentials", []byte{socksMethodNoAuth, socksMethodUserPass}, "alice", "secret", nil, []byte{socksAuthVersion, socksAuthSuccess}},
+		{"bad password", []byte{socksMethodUserPass}, "alice", "wrong", errSocksAuthFailed, []byte{socksAuthVersion, socksAuthFailure}},
+		{"bad username", []byte{socksMethodUserPass}, "bob", "secret", errSocksAuthFailed, []byte{socksAuthVersion, socksAuthFailure}},
+		{"no auth offered", []byte{socksMethodNoAuth}, "", "", errSocksNoAcceptable, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+
+			result := make(chan error, 1)
+			go func() {
+				result <- negotiateSocksAuth(server, "alice", "secret")
+			}()
+
+			writeAll(t, client, socksGreeting(tt.methods...))
+			selection := readExactly(t, client, 2)
+			if tt.wantAuth == nil {
+				if !bytes.Equal(selection, []byte{socksVersion, socksMethodNoAccepted}) {
+					t.Fatalf("unexpected method selection %x", selection)
+				}
+			} else {
+				if !bytes.Equal(selection, []byte{socksVersion, socksMethodUserPass}) {
+					t.Fatalf("unexpected method selection %x", selection)
+				}
+				writeAll(t, client, socksUserPass(tt.user, tt.pass))
+				if status := readExactly(t, client, 2); !bytes.Equal(status, tt.wantAuth) {
+					t.Fatalf("got auth status %x, want %x", status, tt.wantAuth)
+				}
+			}
+
+			if err := <-result; !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGreetSocksAgentDeadline(t *testing.T) {
+	old := socksAuthTimeout
+	socksAuthTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { socksAuthTimeout = old })
+
+	stream, agent := net.Pipe()
+	defer agent.Close()
+	go io.Copy(io.Discard, agent)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- greetSocksAgent(stream)
+	}()
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("expected greeting to fail against a silent agent")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("greeting blocked past the deadline")
+	}
+}
+
+func TestEstablishServerConnectionNoAuth(t *testing.T) {
+	setSocksCredentials(t, "", "")
+	handler, agent := newTestHandler(t)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go handler.establishServerConnection(server)
+
+	greeting := socksGreeting(socksMethodNoAuth)
+	go client.Write(greeting)
+
+	stream := acceptStream(t, agent)
+	defer stream.Close()
+	if got := readExactly(t, stream, len(greeting)); !bytes.Equal(got, greeting) {
+		t.Fatalf("agent got %x, want client greeting passed through unchanged", got)
+	}
+}
+
+func TestEstablishServerConnectionGoodAuth(t *testing.T) {
+	setSocksCredentials(t, "alice", "secret")
+	handler, agent := newTestHandler(t)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go handler.establishServerConnection(server)
+
+	writeAll(t, client, socksGreeting(socksMethodUserPass))
+	readExactly(t, client, 2)
+	writeAll(t, client, socksUserPass("alice", "secret"))
+	if status := readExactly(t, client, 2); status[1] != socksAuthSuccess {
+		t.Fatalf("auth failed with status %x", status)
+	}
+
+	stream := acceptStream(t, agent)
+	defer stream.Close()
+	if got := readExactly(t, stream, 3); !bytes.Equal(got, socksGreeting(socksMethodNoAuth)) {
+		t.Fatalf("agent got greeting %x, want no-auth greeting", got)
+	}
+	writeAll(t, stream, []byte{socksVersion, socksMethodNoAuth})
+
+	go client.Write([]byte("ping"))
+	if got := readExactly(t, stream, 4); string(got) != "ping" {
+		t.Fatalf("agent got %q after auth, want %q", got, "ping")
+	}
+}
+
+func TestEstablishServerConnectionBadAuth(t *testing.T) {
+	setSocksCredentials(t, "alice", "secret")
+	handler, agent := newTestHandler(t)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		handler.establishServerConnection(server)
+		close(done)
+	}()
+
+	writeAll(t, client, socksGreeting(socksMethodUserPass))
+	readExactly(t, client, 2)
+	writeAll(t, client, socksUserPass("alice", "wrong"))
+	if status := readExactly(t, client, 2); status[1] != socksAuthFailure {
+		t.Fatalf("got auth status %x, want failure", status)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected client to be closed, got %v", err)
+	}
+	<-done
+
+	if n := agent.NumStreams(); n != 0 {
+		t.Fatalf("agent has %d streams after rejected auth, want 0", n)
+	}
+}
+
+func TestSilentClientDoesNotBlockAcceptLoop(t *testing.T) {
+	setSocksCredentials(t, "alice", "secret")
+	handler, _ := newTestHandler(t)
+
+	silent, err := net.Dial("tcp", handler.socksClientListener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial socks listener: %v", err)
+	}
+	defer silent.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- handler.handleClientConnection()
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("accept loop returned error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("accept loop blocked on a silent client")
+	}
+	silent.Close()
+	handler.background.Wait()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// torControlTimeout bounds dialing and each exchange with the control port; a
+// variable so tests can shorten it.
+var torControlTimeout = 5 * time.Second
+
+// TorOnion is an ephemeral onion service registered through the tor control
+// port. It is not detached, so tor also removes it when the control
+// connection goes away.
+type TorOnion struct {
+	rawConn   net.Conn
+	conn      *textproto.Conn
+	ServiceID string
+}
+
+func (o *TorOnion) Address() string {
+	return o.ServiceID + ".onion"
+}
+
+// newTorOnion publishes virtualPort on a new v3 onion service that forwards
+// to target, which must be reachable by the local tor daemon.
+func newTorOnion(controlAddr, password string, virtualPort int, target string) (*TorOnion, error) {
+	rawConn, err := net.DialTimeout("tcp", controlAddr, torControlTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach tor control port at %s: %v", controlAddr, err)
+	}
+
+	// A control port that accepts but never answers must not hang startup.
+	if err := rawConn.SetDeadline(time.Now().Add(torControlTimeout)); err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("failed to set tor control deadline: %v", err)
+	}
+
+	onion := &TorOnion{rawConn: rawConn, conn: textproto.NewConn(rawConn)}
+	if err := onion.authenticate(password); err != nil {
+		onion.conn.Close()
+		return nil, fmt.Errorf("failed to authenticate with tor: %v", err)
+	}
+
+	reply, err := onion.command("ADD_ONION NEW:ED25519-V3 Flags=DiscardPK Port=%d,%s", virtualPort, target)
+	if err != nil {
+		onion.conn.Close()
+		return nil, fmt.Errorf("failed to create onion service: %v", err)
+	}
+	for _, line := range strings.Split(reply, "\n") {
+		if id, ok := strings.CutPrefix(line, "ServiceID="); ok {
+			onion.ServiceID = id
+		}
+	}
+	if onion.ServiceID == "" {
+		onion.conn.Close()
+		return nil, fmt.Errorf("tor did not return a service ID")
+	}
+	// The connection stays open for the lifetime of the service.
+	rawConn.SetDeadline(time.Time{})
+	return onion, nil
+}
+
+func (o *TorOnion) authenticate(password string) error {
+	reply, err := o.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+
+	var methods, cookieFile string
+	for _, line := range strings.Split(reply, "\n") {
+		rest, ok := strings.CutPrefix(line, "AUTH METHODS=")
+		if !ok {
+			continue
+		}
+		methods, rest, _ = strings.Cut(rest, " ")
+		if file, ok := strings.CutPrefix(rest, "COOKIEFILE="); ok {
+			cookieFile = strings.Trim(file, `"`)
+		}
+	}
+
+	supported := strings.Split(methods, ",")
+	has := func(method string) bool {
+		for _, m := range supported {
+			if m == method {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case has("NULL"):
+		_, err = o.command("AUTHENTICATE")
+	case has("HASHEDPASSWORD") && password != "":
+		_, err = o.command("AUTHENTICATE %s", torQuote(password))
+	case has("COOKIE") && cookieFile != "":
+		cookie, readErr := os.ReadFile(cookieFile)
+		if readErr != nil {
+			return fmt.Errorf("failed to read auth cookie: %v", readErr)
+		}
+		_, err = o.command("AUTHENTICATE %s", hex.EncodeToString(cookie))
+	default:
+		return fmt.Errorf("no supported auth method (tor offers %q)", methods)
+	}
+	return err
+}
+
+// torQuote encodes s as a control-protocol QuotedString. Only backslash and
+// double quote are escaped; other bytes, including non-ASCII, pass through.
+func torQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (o *TorOnion) command(format string, args ...any) (string, error) {
+	id, err := o.conn.Cmd(format, args...)
+	if err != nil {
+		return "", err
+	}
+	o.conn.StartResponse(id)
+	defer o.conn.EndResponse(id)
+
+	_, message, err := o.conn.ReadResponse(250)
+	return message, err
+}
+
+func (o *TorOnion) Close() error {
+	o.rawConn.SetDeadline(time.Now().Add(torControlTimeout))
+	if _, err := o.command("DEL_ONION %s", o.ServiceID); err != nil {
+		o.conn.Close()
+		return fmt.Errorf("failed to remove onion service: %v", err)
+	}
+	return o.conn.Close()
+}
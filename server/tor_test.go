@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFakeTor serves a scripted tor control port. replies maps a command
+// verb to the raw reply lines; commands without a reply are read and never
+// answered. Every command line received is sent on the returned channel.
+func startFakeTor(t *testing.T, replies map[string]string) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	commands := make(chan string, 16)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := textproto.NewReader(bufio.NewReader(conn))
+		for {
+			line, err := r.ReadLine()
+			if err != nil {
+				close(commands)
+				return
+			}
+			commands <- line
+			verb, _, _ := strings.Cut(line, " ")
+			if reply, ok := replies[verb]; ok {
+				conn.Write([]byte(reply))
+			}
+		}
+	}()
+	return ln.Addr().String(), commands
+}
+
+func drainCommands(commands <-chan string) []string {
+	var got []string
+	for line := range commands {
+		got = append(got, line)
+	}
+	return got
+}
+
+func protocolInfo(authLine string) string {
+	return "250-PROTOCOLINFO 1\r\n250-" + authLine + "\r\n250-VERSION Tor=\"0.4.8.10\"\r\n250 OK\r\n"
+}
+
+const addOnionOK = "250-ServiceID=exampleonionid\r\n250 OK\r\n"
+
+func TestNewTorOnion(t *testing.T) {
+	oldTimeout := torControlTimeout
+	torControlTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { torControlTimeout = oldTimeout })
+
+	cookie := []byte{0xde, 0xad, 0xbe, 0xef}
+	cookieFile := writeTestFile(t, t.TempDir(), "control_auth_cookie", cookie)
+
+	tests := []struct {
+		name     string
+		password string
+		replies  map[string]string
+		wantAuth string
+		wantErr  string
+	}{
+		{
+			name: "null auth",
+			replies: map[string]string{
+				"PROTOCOLINFO": protocolInfo("AUTH METHODS=NULL"),
+				"AUTHENTICATE": "250 OK\r\n",
+				"ADD_ONION":    addOnionOK,
+				"DEL_ONION":    "250 OK\r\n",
+			},
+			wantAuth: "AUTHENTICATE",
+		},
+		{
+			name:     "hashed password",
+			password: `pa"ss\wörd`,
+			replies: map[string]string{
+				"PROTOCOLINFO": protocolInfo("AUTH METHODS=HASHEDPASSWORD"),
+				"AUTHENTICATE": "250 OK\r\n",
+				"ADD_ONION":    addOnionOK,
+				"DEL_ONION":    "250 OK\r\n",
+			},
+			wantAuth: `AUTHENTICATE "pa\"ss\\wörd"`,
+		},
+		{
+			name: "cookie",
+			replies: map[string]string{
+				"PROTOCOLINFO": protocolInfo(`AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE="` + cookieFile + `"`),
+				"AUTHENTICATE": "250 OK\r\n",
+				"ADD_ONION":    addOnionOK,
+				"DEL_ONION":    "250 OK\r\n",
+			},
+			wantAuth: "AUTHENTICATE " + hex.EncodeToString(cookie),
+		},
+		{
+			name: "missing service ID",
+			replies: map[string]string{
+				"PROTOCOLINFO": protocolInfo("AUTH METHODS=NULL"),
+				"AUTHENTICATE": "250 OK\r\n",
+				"ADD_ONION":    "250 OK\r\n",
+			},
+			wantErr: "did not return a service ID",
+		},
+		{
+			name:     "authentication rejected",
+			password: "wrong",
+			replies: map[string]string{
+				"PROTOCOLINFO": protocolInfo("AUTH METHODS=HASHEDPASSWORD"),
+				"AUTHENTICATE": "515 Authentication failed: Password did not match HashedControlPassword value from configuration\r\n",
+			},
+			wantErr: "failed to authenticate",
+		},
+		{
+			name: "no usable auth method",
+			replies: map[string]string{
+				"PROTOCOLINFO": protocolInfo("AUTH METHODS=HASHEDPASSWORD"),
+			},
+			wantErr: "no supported auth method",
+		},
+		{
+			name:    "silent control port",
+			wantErr: "failed to authenticate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, commands := startFakeTor(t, tt.replies)
+
+			start := time.Now()
+			onion, err := newTorOnion(addr, tt.password, 9000, "127.0.0.1:9000")
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("newTorOnion took %v", elapsed)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newTorOnion: %v", err)
+			}
+			if got := onion.Address(); got != "exampleonionid.onion" {
+				t.Fatalf("address = %q", got)
+			}
+			if err := onion.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			want := []string{
+				"PROTOCOLINFO 1",
+				tt.wantAuth,
+				"ADD_ONION NEW:ED25519-V3 Flags=DiscardPK Port=9000,127.0.0.1:9000",
+				"DEL_ONION exampleonionid",
+			}
+			got := drainCommands(commands)
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Fatalf("control commands:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestNewTorOnionUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = newTorOnion(addr, "", 9000, "127.0.0.1:9000")
+	if err == nil || !strings.Contains(err.Error(), "failed to reach tor control port") {
+		t.Fatalf("got %v, want unreachable error", err)
+	}
+}
+
+func TestTorQuote(t *testing.T) {
+	if got, want := torQuote(`a"b\c ü`), `"a\"b\\c ü"`; got != want {
+		t.Fatalf("torQuote = %s, want %s", got, want)
+	}
+}